@@ -0,0 +1,27 @@
+// Command memberlist-keygen generates an encryption key suitable for a
+// memberlist.Config's SecretKey (or for use with Keyring), and prints it
+// base64-encoded so it can be pasted directly into a config file. It
+// mirrors the "keygen" subcommand shipped with Nomad and Consul.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func main() {
+	size := flag.Int("size", 32, "key size in bytes: 16 (AES-128), 24 (AES-192), or 32 (AES-256)")
+	flag.Parse()
+
+	key, err := memberlist.GenerateKey(*size)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating key: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+}
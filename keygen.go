@@ -0,0 +1,26 @@
+package memberlist
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// GenerateKey returns size bytes of cryptographically random key material
+// suitable for use with Keyring.AddKey. size must be 16, 24, or 32, yielding
+// an AES-128, AES-192, or AES-256 key respectively. Centralizing this here
+// means consumers no longer need to hand-roll their own rand.Read snippet,
+// and that the entropy read is validated to have actually filled the key.
+func GenerateKey(size int) ([]byte, error) {
+	switch size {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("key size must be 16, 24, or 32 bytes")
+	}
+
+	key := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to read random data: %v", err)
+	}
+	return key, nil
+}
@@ -4,23 +4,56 @@ import (
 	"bytes"
 	"fmt"
 	"sync"
+	"time"
 )
 
+// keyringEntry pairs an installed key with the term it was installed under.
+// The term is a monotonically increasing identifier that lets peers label
+// encrypted traffic with the exact key used to produce it, rather than
+// forcing recipients to trial-decrypt against every key they hold.
+type keyringEntry struct {
+	key         []byte
+	term        uint32
+	installedAt time.Time
+}
+
 type Keyring struct {
 	// The keyring lock gives us stronger consistency gurantees while performing
 	// IO operations that alter or read from the keyring.
 	keyringLock sync.Mutex
 
-	// Keys stores the key data used during encryption and decryption. It is
-	// ordered in such a way where the first key (index 0) is the primary key,
+	// entries stores the key data used during encryption and decryption. It is
+	// ordered in such a way where the first entry (index 0) is the primary key,
 	// which is used for encrypting messages, and is the first key tried during
 	// message decryption.
-	keys [][]byte
+	entries []*keyringEntry
+
+	// nextTerm is the term that will be assigned to the next key added via
+	// AddKey. Terms only ever increase for the lifetime of the keyring, so a
+	// term uniquely identifies a key even after it has been removed.
+	nextTerm uint32
+
+	// store, if set, is saved to after every mutating operation so the
+	// keyring survives a restart. A nil store disables persistence, which
+	// is the default so that NewKeyring keeps working with no behavior
+	// change for callers that don't opt in.
+	store KeyringStore
+
+	// rotation holds the automatic rotation policy, if one has been set via
+	// SetRotationConfig. A nil rotation disables RotationDue/Rotate.
+	rotation *KeyRotationConfig
+
+	// opCounts tracks how many times each key (by term) has been used to
+	// encrypt an outbound message, so RotationDue can tell when a key is
+	// approaching the point where reusing it risks AES-GCM nonce collision.
+	opCounts map[uint32]uint64
 }
 
 // Init allocates substructures
 func (k *Keyring) init() {
-	k.keys = make([][]byte, 0)
+	k.entries = make([]*keyringEntry, 0)
+	k.opCounts = make(map[uint32]uint64)
+	k.nextTerm = 1
 }
 
 // NewKeyring constructs a new container for a set of encryption keys. The
@@ -56,38 +89,76 @@ func NewKeyring(keys [][]byte, primaryKey []byte) (*Keyring, error) {
 	return keyring, nil
 }
 
+// validateKeySize enforces that a key is a valid AES key size: 16 bytes
+// selects AES-128, 24 bytes selects AES-192, and 32 bytes selects AES-256.
+func validateKeySize(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key size must be 16, 24, or 32 bytes")
+	}
+}
+
 // AddKey will install a new key on the ring. Adding a key to the ring will make
 // it available for use in decryption. If the key already exists on the ring,
-// this function will just return noop.
+// this function will just return noop. The key is assigned the next available
+// term; use AddKeyWithTerm to install a key under a specific term, such as when
+// syncing keys that another node has already assigned a term to.
 func (k *Keyring) AddKey(key []byte) error {
-	// Encorce 16-byte key size
-	if len(key) != 16 {
-		return fmt.Errorf("key size must be 16 bytes")
+	if err := validateKeySize(key); err != nil {
+		return err
 	}
 
 	// No-op if key is already installed
-	for _, installedKey := range k.keys {
-		if bytes.Equal(installedKey, key) {
+	for _, entry := range k.entries {
+		if bytes.Equal(entry.key, key) {
 			return nil
 		}
 	}
 
-	keys := append(k.keys, key)
+	return k.AddKeyWithTerm(key, k.nextTerm)
+}
+
+// AddKeyWithTerm behaves like AddKey, but labels the installed key with the
+// given term rather than allocating the next one. This is used when a key is
+// being synced in from another node or restored from a persisted keyring, and
+// the term must be preserved so that ciphertext produced elsewhere can still
+// be matched to the right key via GetKeyByTerm.
+func (k *Keyring) AddKeyWithTerm(key []byte, term uint32) error {
+	if err := validateKeySize(key); err != nil {
+		return err
+	}
+
+	for _, entry := range k.entries {
+		if bytes.Equal(entry.key, key) {
+			return nil
+		}
+		if entry.term == term {
+			return fmt.Errorf("term %d is already in use by another key", term)
+		}
+	}
+
+	entries := append(k.entries, &keyringEntry{key: key, term: term, installedAt: time.Now()})
 	primaryKey := k.GetPrimaryKey()
 	if primaryKey == nil {
 		primaryKey = key
 	}
-	k.setKeys(keys, primaryKey)
-	return nil
+	k.setKeys(entries, primaryKey)
+
+	if term >= k.nextTerm {
+		k.nextTerm = term + 1
+	}
+	return k.save()
 }
 
 // UseKey changes the key used to encrypt messages. This is the only key used to
 // encrypt messages, so peers should know this key before this method is called.
 func (k *Keyring) UseKey(key []byte) error {
-	for _, installedKey := range k.keys {
-		if bytes.Equal(key, installedKey) {
-			k.setKeys(k.keys, key)
-			return nil
+	for _, entry := range k.entries {
+		if bytes.Equal(key, entry.key) {
+			k.setKeys(k.entries, key)
+			return k.save()
 		}
 	}
 	return fmt.Errorf("Requested key is not in the keyring")
@@ -96,32 +167,46 @@ func (k *Keyring) UseKey(key []byte) error {
 // RemoveKey drops a key from the keyring. This will return an error if the key
 // requested for removal is currently at position 0 (primary key).
 func (k *Keyring) RemoveKey(key []byte) error {
-	if bytes.Equal(key, k.keys[0]) {
+	if bytes.Equal(key, k.entries[0].key) {
 		return fmt.Errorf("Removing the active key is not allowed")
 	}
-	for i, installedKey := range k.keys {
-		if bytes.Equal(key, installedKey) {
-			keys := append(k.keys[:i], k.keys[i+1:]...)
-			k.setKeys(keys, k.keys[0])
+	for i, entry := range k.entries {
+		if bytes.Equal(key, entry.key) {
+			entries := append(k.entries[:i], k.entries[i+1:]...)
+			k.setKeys(entries, k.entries[0].key)
+
+			k.keyringLock.Lock()
+			delete(k.opCounts, entry.term)
+			k.keyringLock.Unlock()
+			break
 		}
 	}
-	return nil
+	return k.save()
 }
 
 // setKeys will take out a lock on the keyring, and replace the keys with a new
-// set of keys. The key indicated by primaryKey will be installed as the new
+// set of entries. The key indicated by primaryKey will be installed as the new
 // primary key.
-func (k *Keyring) setKeys(keys [][]byte, primaryKey []byte) {
+func (k *Keyring) setKeys(entries []*keyringEntry, primaryKey []byte) {
 	k.keyringLock.Lock()
 	defer k.keyringLock.Unlock()
 
-	installKeys := [][]byte{primaryKey}
-	for _, key := range keys {
-		if !bytes.Equal(key, primaryKey) {
-			installKeys = append(installKeys, key)
+	var primaryEntry *keyringEntry
+	installEntries := make([]*keyringEntry, 0, len(entries))
+	for _, entry := range entries {
+		if bytes.Equal(entry.key, primaryKey) {
+			primaryEntry = entry
+			continue
 		}
+		installEntries = append(installEntries, entry)
 	}
-	k.keys = installKeys
+	if primaryEntry == nil {
+		// Should not happen in practice, but guard against losing the
+		// primary key if callers pass a mismatched primaryKey.
+		primaryEntry = &keyringEntry{key: primaryKey, term: k.nextTerm}
+		k.nextTerm++
+	}
+	k.entries = append([]*keyringEntry{primaryEntry}, installEntries...)
 }
 
 // GetKeys returns the current set of keys on the ring.
@@ -129,7 +214,11 @@ func (k *Keyring) GetKeys() [][]byte {
 	k.keyringLock.Lock()
 	defer k.keyringLock.Unlock()
 
-	return k.keys
+	keys := make([][]byte, len(k.entries))
+	for i, entry := range k.entries {
+		keys[i] = entry.key
+	}
+	return keys
 }
 
 // GetPrimaryKey returns the key on the ring at position 0. This is the key used
@@ -138,8 +227,156 @@ func (k *Keyring) GetPrimaryKey() (key []byte) {
 	k.keyringLock.Lock()
 	defer k.keyringLock.Unlock()
 
-	if len(k.keys) > 0 {
-		key = k.keys[0]
+	if len(k.entries) > 0 {
+		key = k.entries[0].key
 	}
 	return
 }
+
+// EncryptionKey returns the key and term that should be used to encrypt the
+// next outbound message, and records the operation against that key's usage
+// count so RotationDue can tell when the primary key is due for replacement.
+func (k *Keyring) EncryptionKey() (key []byte, term uint32) {
+	k.keyringLock.Lock()
+	defer k.keyringLock.Unlock()
+
+	if len(k.entries) == 0 {
+		return nil, 0
+	}
+	primary := k.entries[0]
+	k.opCounts[primary.term]++
+	return primary.key, primary.term
+}
+
+// ActiveTerm returns the term of the current primary key, i.e. the term that
+// will be stamped on newly encrypted messages. Callers holding an empty
+// keyring get back 0, which is never a valid assigned term.
+func (k *Keyring) ActiveTerm() uint32 {
+	k.keyringLock.Lock()
+	defer k.keyringLock.Unlock()
+
+	if len(k.entries) == 0 {
+		return 0
+	}
+	return k.entries[0].term
+}
+
+// GetKeyByTerm returns the key installed under the given term, along with
+// whether such a key is currently on the ring. This allows a receiver to look
+// up the exact key a message was encrypted with instead of trial-decrypting
+// against every installed key in order.
+func (k *Keyring) GetKeyByTerm(term uint32) ([]byte, bool) {
+	k.keyringLock.Lock()
+	defer k.keyringLock.Unlock()
+
+	for _, entry := range k.entries {
+		if entry.term == term {
+			return entry.key, true
+		}
+	}
+	return nil, false
+}
+
+// TermForKey returns the term currently assigned to key, if it is installed.
+// The cluster-wide install RPC uses this on the originating node so every
+// other node can be told to install the key under that exact term via
+// AddKeyWithTerm, instead of each node allocating its own local term for
+// what must be the same key everywhere.
+func (k *Keyring) TermForKey(key []byte) (uint32, bool) {
+	k.keyringLock.Lock()
+	defer k.keyringLock.Unlock()
+
+	for _, entry := range k.entries {
+		if bytes.Equal(entry.key, key) {
+			return entry.term, true
+		}
+	}
+	return 0, false
+}
+
+// SetStore attaches a KeyringStore that the keyring will persist to from now
+// on. If the store already holds a previously-saved keyring, it replaces
+// whatever keys are currently installed; otherwise the keyring's current
+// contents (if any) are saved to the store immediately. A persisted keyring
+// that holds no keys leaves the current keys in place and is not overwritten
+// until the next mutation. A memberlist Config
+// that sets up a KeyringStore should call this once, before the keyring is
+// handed off for use, so every later mutation is saved automatically.
+func (k *Keyring) SetStore(store KeyringStore) error {
+	enc, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load persisted keyring: %v", err)
+	}
+
+	k.keyringLock.Lock()
+	k.store = store
+	k.keyringLock.Unlock()
+
+	if enc == nil {
+		return k.save()
+	}
+	return k.restore(enc)
+}
+
+// restore replaces the keyring's contents with a previously persisted
+// EncodedKeyring. It does not re-save, since the data just came from the
+// store.
+func (k *Keyring) restore(enc *EncodedKeyring) error {
+	entries := make([]*keyringEntry, 0, len(enc.Keys))
+	var primaryKey []byte
+	var nextTerm uint32
+	for _, ek := range enc.Keys {
+		if err := validateKeySize(ek.Key); err != nil {
+			return fmt.Errorf("invalid key in persisted keyring: %v", err)
+		}
+		entries = append(entries, &keyringEntry{key: ek.Key, term: ek.Term, installedAt: ek.InstalledAt})
+		if ek.Term == enc.PrimaryTerm {
+			primaryKey = ek.Key
+		}
+		if ek.Term >= nextTerm {
+			nextTerm = ek.Term + 1
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if primaryKey == nil {
+		return fmt.Errorf("persisted keyring has no key for primary term %d", enc.PrimaryTerm)
+	}
+
+	k.setKeys(entries, primaryKey)
+	k.keyringLock.Lock()
+	if nextTerm > k.nextTerm {
+		k.nextTerm = nextTerm
+	}
+	k.keyringLock.Unlock()
+	return nil
+}
+
+// save persists the current keyring contents to the attached store, if any.
+// It is a no-op when no store has been set via SetStore.
+func (k *Keyring) save() error {
+	k.keyringLock.Lock()
+	store := k.store
+	if store == nil {
+		k.keyringLock.Unlock()
+		return nil
+	}
+
+	enc := &EncodedKeyring{
+		Keys: make([]EncodedKeyringKey, len(k.entries)),
+	}
+	if len(k.entries) > 0 {
+		enc.PrimaryTerm = k.entries[0].term
+	}
+	for i, entry := range k.entries {
+		enc.Keys[i] = EncodedKeyringKey{
+			Key:         entry.key,
+			Term:        entry.term,
+			InstalledAt: entry.installedAt,
+		}
+	}
+	k.keyringLock.Unlock()
+
+	return store.Save(enc)
+}
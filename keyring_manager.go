@@ -0,0 +1,381 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// keyMgmtMsg is the messageType used to carry keyring-management RPCs
+// (install/use/remove/list) as a reliable user message. A received
+// keyMgmtMsg is processed by handleKeyManagerMessage, not by the configured
+// Delegate; the message-receiving code does not call handleKeyManagerMessage
+// itself, so keyMgmtMsg traffic is not routed to it automatically.
+const keyMgmtMsg messageType = 14
+
+// keyManagerOp identifies which keyring operation a keyManagerRequest is
+// asking a node to perform.
+type keyManagerOp uint8
+
+const (
+	keyManagerInstall keyManagerOp = iota
+	keyManagerUse
+	keyManagerRemove
+	keyManagerList
+)
+
+// keyManagerRequest is broadcast to every known node as a keyMgmtMsg. Term
+// is only meaningful for keyManagerInstall: the originating node assigns the
+// term once (allocating a fresh one locally, or reusing the term if it
+// already holds the key), and every recipient installs under that exact
+// term via AddKeyWithTerm, so the same physical key carries the same term
+// cluster-wide and can be resolved by Keyring.GetKeyByTerm during decrypt.
+type keyManagerRequest struct {
+	ReqID uint64
+	From  string
+	Op    keyManagerOp
+	Key   []byte
+	Term  uint32
+}
+
+// keyManagerAck is sent back to the requesting node in response to a
+// keyManagerRequest, also as a keyMgmtMsg.
+type keyManagerAck struct {
+	ReqID uint64
+	From  string
+	Error string
+
+	// Keys holds the raw key material currently installed on the
+	// responding node, Keys[0] always being its primary. It is only set on
+	// acks to a keyManagerList request -- install/use/remove acks carry no
+	// key material, just success or Error.
+	Keys [][]byte
+
+	IsReply bool
+}
+
+// KeyResponse aggregates the per-node results of an InstallKey, UseKey,
+// RemoveKey, or ListKeys call. It is modeled on Serf/Consul's keyring
+// manager response so operators get the same "did everyone converge"
+// picture those tools already expect.
+type KeyResponse struct {
+	// Messages maps node name to error string, for any node that failed
+	// the operation or didn't respond before the timeout.
+	Messages map[string]string
+
+	// NumNodes is the number of nodes the operation was attempted against.
+	NumNodes int
+
+	// NumResp is the number of nodes that replied before the timeout.
+	NumResp int
+
+	// NumErr is the number of nodes that replied with, or were recorded
+	// with, an error.
+	NumErr int
+
+	// Keys maps each key's fingerprint (base64 of the raw key bytes) to the
+	// number of nodes reporting it installed. Only populated by ListKeys.
+	// Fingerprinting on the key itself, rather than on a node-local term,
+	// is what makes this a reliable convergence check: two nodes that
+	// installed the same key under different terms still agree here.
+	Keys map[string]int
+
+	// PrimaryKeys maps each key fingerprint to the number of nodes
+	// reporting it as their primary key. Only populated by ListKeys.
+	PrimaryKeys map[string]int
+}
+
+func newKeyResponse() *KeyResponse {
+	return &KeyResponse{
+		Messages:    make(map[string]string),
+		Keys:        make(map[string]int),
+		PrimaryKeys: make(map[string]int),
+	}
+}
+
+// keyFingerprint returns the stable identifier a KeyResponse uses to report
+// on a key, independent of whatever term any given node happens to have
+// assigned it locally.
+func keyFingerprint(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// keyManagerRPCTimeout bounds how long InstallKey/UseKey/RemoveKey/ListKeys
+// wait for acks from the rest of the cluster before reporting every node that
+// has not replied as a non-response.
+const keyManagerRPCTimeout = 10 * time.Second
+
+// keyManager tracks in-flight keyring-management RPCs so that acks received
+// asynchronously (via handleKeyManagerMessage) can be routed back to the
+// goroutine blocked in InstallKey/UseKey/RemoveKey/ListKeys. Memberlist owns
+// a single instance of this, created lazily on first use.
+type keyManager struct {
+	nextReqID uint64
+
+	mu      sync.Mutex
+	pending map[uint64]chan *keyManagerAck
+}
+
+// register allocates the ack channel for a new in-flight request. expected
+// should be the number of remote acks the caller intends to wait for (i.e.
+// one per node contacted over the network); the channel is buffered to that
+// size so that concurrent handleConn goroutines delivering acks for the same
+// ReqID never race each other out with deliver's non-blocking send.
+func (km *keyManager) register(reqID uint64, expected int) chan *keyManagerAck {
+	ch := make(chan *keyManagerAck, expected)
+	km.mu.Lock()
+	if km.pending == nil {
+		km.pending = make(map[uint64]chan *keyManagerAck)
+	}
+	km.pending[reqID] = ch
+	km.mu.Unlock()
+	return ch
+}
+
+func (km *keyManager) deregister(reqID uint64) {
+	km.mu.Lock()
+	delete(km.pending, reqID)
+	km.mu.Unlock()
+}
+
+func (km *keyManager) deliver(ack *keyManagerAck) {
+	km.mu.Lock()
+	ch, ok := km.pending[ack.ReqID]
+	km.mu.Unlock()
+	if ok {
+		select {
+		case ch <- ack:
+		default:
+		}
+	}
+}
+
+// InstallKey installs a new key on every node's keyring without making it
+// primary. This is the first step of a rotation: operators install the new
+// key everywhere, confirm convergence with ListKeys, then call UseKey to cut
+// over, then RemoveKey to retire the old one.
+func (m *Memberlist) InstallKey(key []byte) (*KeyResponse, error) {
+	return m.keyManagerRPC(keyManagerInstall, key)
+}
+
+// UseKey changes the primary encryption key cluster-wide. Every node should
+// already have the key installed via InstallKey, or it will be unable to
+// decrypt traffic from nodes that have switched over to it.
+func (m *Memberlist) UseKey(key []byte) (*KeyResponse, error) {
+	return m.keyManagerRPC(keyManagerUse, key)
+}
+
+// RemoveKey removes a key from every node's keyring. This is the final step
+// of a rotation, run once operators are confident no traffic still relies on
+// the retired key.
+func (m *Memberlist) RemoveKey(key []byte) (*KeyResponse, error) {
+	return m.keyManagerRPC(keyManagerRemove, key)
+}
+
+// ListKeys queries every node for the keys it currently holds and which one
+// is primary, reported by fingerprint rather than by node-local term.
+// Operators use this between InstallKey and UseKey to confirm the cluster
+// has converged before cutting over.
+func (m *Memberlist) ListKeys() (*KeyResponse, error) {
+	return m.keyManagerRPC(keyManagerList, nil)
+}
+
+// keyManagerRPC broadcasts a keyring-management request to every known node
+// over a reliable user message and aggregates the responses into a
+// KeyResponse, waiting up to keyManagerRPCTimeout for stragglers.
+func (m *Memberlist) keyManagerRPC(op keyManagerOp, key []byte) (*KeyResponse, error) {
+	if m.config.Keyring == nil {
+		return nil, fmt.Errorf("encryption is not enabled for this memberlist, keyring management is unavailable")
+	}
+
+	members := m.Members()
+	var remote []*Node
+	for _, n := range members {
+		if n.Name != m.config.Name {
+			remote = append(remote, n)
+		}
+	}
+
+	// For install, fix the term once on the originating node so every
+	// other node installs the same physical key under the same term,
+	// instead of each node allocating its own local term for it.
+	var term uint32
+	if op == keyManagerInstall {
+		keyring := m.config.Keyring
+		if t, ok := keyring.TermForKey(key); ok {
+			term = t
+		} else {
+			if err := keyring.AddKey(key); err != nil {
+				return nil, fmt.Errorf("failed to install key locally: %v", err)
+			}
+			t, ok := keyring.TermForKey(key)
+			if !ok {
+				return nil, fmt.Errorf("failed to determine term for newly installed key")
+			}
+			term = t
+		}
+	}
+
+	reqID := atomic.AddUint64(&m.keyManager.nextReqID, 1)
+	req := &keyManagerRequest{ReqID: reqID, From: m.config.Name, Op: op, Key: key, Term: term}
+
+	raw, err := encodeKeyManagerMsg(keyMgmtMsg, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode keyring request: %v", err)
+	}
+
+	// Size the ack channel for every remote node we're about to contact, so
+	// that acks landing concurrently from distinct handleConn goroutines
+	// never race each other out of deliver's non-blocking send.
+	ackCh := m.keyManager.register(reqID, len(remote))
+	defer m.keyManager.deregister(reqID)
+
+	resp := newKeyResponse()
+	resp.NumNodes = len(members)
+
+	for _, n := range members {
+		if n.Name == m.config.Name {
+			ack := m.handleKeyManagerRequest(req)
+			m.recordKeyManagerAck(resp, n.Name, ack)
+			break
+		}
+	}
+
+	// Only nodes we actually managed to send to are waited on below; a node
+	// whose SendReliable failed will never ack, so it must not hold up the
+	// wait loop until the full timeout.
+	pending := make(map[string]struct{})
+	for _, n := range remote {
+		if err := m.SendReliable(n, raw); err != nil {
+			resp.NumErr++
+			resp.Messages[n.Name] = err.Error()
+			continue
+		}
+		pending[n.Name] = struct{}{}
+	}
+
+	deadline := time.After(keyManagerRPCTimeout)
+	for len(pending) > 0 {
+		select {
+		case ack := <-ackCh:
+			delete(pending, ack.From)
+			m.recordKeyManagerAck(resp, ack.From, ack)
+		case <-deadline:
+			for name := range pending {
+				resp.NumErr++
+				resp.Messages[name] = "no response before timeout"
+			}
+			return resp, nil
+		}
+	}
+	return resp, nil
+}
+
+func (m *Memberlist) recordKeyManagerAck(resp *KeyResponse, from string, ack *keyManagerAck) {
+	resp.NumResp++
+	if ack.Error != "" {
+		resp.NumErr++
+		resp.Messages[from] = ack.Error
+		return
+	}
+	for i, key := range ack.Keys {
+		fp := keyFingerprint(key)
+		resp.Keys[fp]++
+		if i == 0 {
+			resp.PrimaryKeys[fp]++
+		}
+	}
+}
+
+// handleKeyManagerMessage processes a received keyMgmtMsg. The gossip layer's
+// message dispatch does not call it; it runs only where a caller passes it
+// the raw keyMgmtMsg bytes. It demuxes
+// between an incoming request (another node asking us to mutate our
+// keyring) and a reply to one of our own outstanding requests.
+func (m *Memberlist) handleKeyManagerMessage(buf []byte) {
+	var wrapper struct {
+		IsReply bool
+	}
+	if err := decodeKeyManagerMsg(buf, &wrapper); err != nil {
+		return
+	}
+
+	if wrapper.IsReply {
+		var ack keyManagerAck
+		if err := decodeKeyManagerMsg(buf, &ack); err != nil {
+			return
+		}
+		m.keyManager.deliver(&ack)
+		return
+	}
+
+	var req keyManagerRequest
+	if err := decodeKeyManagerMsg(buf, &req); err != nil {
+		return
+	}
+	ack := m.handleKeyManagerRequest(&req)
+
+	raw, err := encodeKeyManagerMsg(keyMgmtMsg, ack)
+	if err != nil {
+		return
+	}
+	if node := m.nodeByName(req.From); node != nil {
+		m.SendReliable(node, raw)
+	}
+}
+
+// handleKeyManagerRequest performs the requested keyring mutation locally
+// and builds the ack to send back to the requester.
+func (m *Memberlist) handleKeyManagerRequest(req *keyManagerRequest) *keyManagerAck {
+	ack := &keyManagerAck{ReqID: req.ReqID, From: m.config.Name, IsReply: true}
+
+	keyring := m.config.Keyring
+	var err error
+	switch req.Op {
+	case keyManagerInstall:
+		err = keyring.AddKeyWithTerm(req.Key, req.Term)
+	case keyManagerUse:
+		err = keyring.UseKey(req.Key)
+	case keyManagerRemove:
+		err = keyring.RemoveKey(req.Key)
+	case keyManagerList:
+		// no mutation; fall through to reporting current state below
+	default:
+		err = fmt.Errorf("unknown keyring operation %d", req.Op)
+	}
+	if err != nil {
+		ack.Error = err.Error()
+		return ack
+	}
+
+	if req.Op == keyManagerList {
+		ack.Keys = keyring.GetKeys()
+	}
+	return ack
+}
+
+func encodeKeyManagerMsg(t messageType, in interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(uint8(t))
+
+	handle := codec.MsgpackHandle{}
+	encoder := codec.NewEncoder(buf, &handle)
+	if err := encoder.Encode(in); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeKeyManagerMsg(buf []byte, out interface{}) error {
+	if len(buf) < 1 {
+		return fmt.Errorf("missing keyring message header")
+	}
+	handle := codec.MsgpackHandle{}
+	decoder := codec.NewDecoder(bytes.NewReader(buf[1:]), &handle)
+	return decoder.Decode(out)
+}
@@ -0,0 +1,195 @@
+package memberlist
+
+import (
+	"fmt"
+	"time"
+)
+
+// generateKey is an alias for GenerateKey used internally by the rotation
+// loop; it exists so the rotation code reads the same whether it's
+// generating a key for a manual Rotate or an automatic one.
+func generateKey(size int) ([]byte, error) {
+	return GenerateKey(size)
+}
+
+// defaultMaxKeyOps bounds how many times a single key may be used to
+// encrypt a message before it is considered due for rotation. AES-GCM's
+// nonce is only 96 bits and NIST recommends against using a single key for
+// more than 2^32 invocations; we rotate well before that, the same margin
+// Vault uses for its transit barrier keys.
+const defaultMaxKeyOps = 3800000000
+
+// defaultMinRotationInterval is the minimum time since the primary key was
+// installed before it is eligible for operation-count-triggered rotation, so
+// a burst of traffic can't force back-to-back rotations.
+const defaultMinRotationInterval = 1 * time.Hour
+
+// defaultMaxKeyAge is the pure time-based rotation trigger: the primary key is
+// rotated once it was installed this long ago, even on a quiet cluster that would
+// never reach MaxOps on its own.
+const defaultMaxKeyAge = 24 * time.Hour
+
+// keyRotationCheckInterval is how often the background rotation loop polls
+// RotationDue.
+const keyRotationCheckInterval = 1 * time.Minute
+
+// keyRemovalGracePeriod is how long a retired primary key is kept installed
+// (so in-flight and reordered messages still decrypt) before the cluster-wide
+// rotation loop removes it.
+const keyRemovalGracePeriod = 10 * time.Minute
+
+// KeyRotationConfig controls automatic primary key rotation on a Keyring.
+// Rotation fires on two independent triggers: a pure time-based one (MaxAge)
+// and an operation-count one (MaxOps) that's additionally gated behind a
+// minimum-spacing floor (MinInterval).
+type KeyRotationConfig struct {
+	// MaxOps is the number of encryption operations a key may be used for
+	// before it becomes eligible for rotation, once MinInterval has also
+	// elapsed.
+	MaxOps uint64
+
+	// MinInterval is the minimum time that must have elapsed since the
+	// primary key was installed before RotationDue will report true on
+	// operation count alone, even if MaxOps has already been exceeded. This
+	// is a spacing floor, not a trigger on its own: it exists so a burst of
+	// traffic can't force back-to-back rotations.
+	MinInterval time.Duration
+
+	// MaxAge is a pure time-based trigger: once the primary key has been
+	// installed for at least this long, RotationDue reports true
+	// regardless of MaxOps or MinInterval. A key rotated purely on
+	// operation count could otherwise sit as primary indefinitely on a
+	// quiet cluster. Zero disables this trigger.
+	MaxAge time.Duration
+
+	// Disabled turns off automatic rotation. RotationDue always reports
+	// false and Rotate returns an error.
+	Disabled bool
+}
+
+// DefaultKeyRotationConfig returns sane defaults for automatic key rotation:
+// rotate after ~3.8 billion operations (but never sooner than 1 hour after
+// the primary key was installed), or 24 hours after it was installed
+// regardless of operation count.
+func DefaultKeyRotationConfig() *KeyRotationConfig {
+	return &KeyRotationConfig{
+		MaxOps:      defaultMaxKeyOps,
+		MinInterval: defaultMinRotationInterval,
+		MaxAge:      defaultMaxKeyAge,
+	}
+}
+
+// SetRotationConfig installs the automatic rotation policy used by
+// RotationDue and enforced by the background rotation loop. Passing nil
+// disables automatic rotation, equivalent to Disabled: true.
+func (k *Keyring) SetRotationConfig(cfg *KeyRotationConfig) {
+	k.keyringLock.Lock()
+	defer k.keyringLock.Unlock()
+	k.rotation = cfg
+}
+
+// RotationDue reports whether the primary key should be rotated: either it
+// was installed at least MaxAge ago, or it was installed at least
+// MinInterval ago and has been used at least MaxOps times. Age is measured
+// from when the key was installed, not from when it became primary. It
+// always returns false if no rotation policy has been set or the policy is
+// disabled.
+func (k *Keyring) RotationDue() bool {
+	k.keyringLock.Lock()
+	cfg := k.rotation
+	if cfg == nil || cfg.Disabled || len(k.entries) == 0 {
+		k.keyringLock.Unlock()
+		return false
+	}
+	primary := k.entries[0]
+	ops := k.opCounts[primary.term]
+	age := time.Since(primary.installedAt)
+	k.keyringLock.Unlock()
+
+	if cfg.MaxAge > 0 && age >= cfg.MaxAge {
+		return true
+	}
+	return age >= cfg.MinInterval && ops >= cfg.MaxOps
+}
+
+// Rotate generates a fresh key of the same size as the current primary,
+// installs it, and promotes it to primary, all within this single Keyring.
+// It does not retire the old key -- callers that want the old key removed
+// once it's safe to do so should call RemoveKey themselves, or rely on the
+// cluster-wide rotation loop (see Memberlist.InstallKey/UseKey/RemoveKey)
+// which handles the gossip and grace period for a multi-node cluster. Rotate
+// is mainly useful for manually triggering a rotation, or for single-node
+// testing.
+func (k *Keyring) Rotate() error {
+	k.keyringLock.Lock()
+	cfg := k.rotation
+	k.keyringLock.Unlock()
+	if cfg == nil || cfg.Disabled {
+		return fmt.Errorf("key rotation is not configured for this keyring")
+	}
+
+	primary := k.GetPrimaryKey()
+	if primary == nil {
+		return fmt.Errorf("cannot rotate, keyring has no primary key")
+	}
+
+	newKey, err := generateKey(len(primary))
+	if err != nil {
+		return fmt.Errorf("failed to generate rotation key: %v", err)
+	}
+	if err := k.AddKey(newKey); err != nil {
+		return err
+	}
+	return k.UseKey(newKey)
+}
+
+// maybeRotateKey checks whether the keyring's primary key is due for
+// rotation and, if so, drives a full cluster-wide rotation: generate a new
+// key, install it everywhere, promote it to primary everywhere, then remove
+// the old key once keyRemovalGracePeriod has passed.
+func (m *Memberlist) maybeRotateKey() error {
+	keyring := m.config.Keyring
+	if keyring == nil || !keyring.RotationDue() {
+		return nil
+	}
+
+	oldKey := keyring.GetPrimaryKey()
+	newKey, err := generateKey(len(oldKey))
+	if err != nil {
+		return fmt.Errorf("failed to generate rotation key: %v", err)
+	}
+
+	if _, err := m.InstallKey(newKey); err != nil {
+		return fmt.Errorf("failed to install new key cluster-wide: %v", err)
+	}
+	if _, err := m.UseKey(newKey); err != nil {
+		return fmt.Errorf("failed to promote new key cluster-wide: %v", err)
+	}
+
+	time.AfterFunc(keyRemovalGracePeriod, func() {
+		if _, err := m.RemoveKey(oldKey); err != nil {
+			m.logger.Printf("[ERR] memberlist: failed to remove retired key after rotation: %v", err)
+		}
+	})
+	return nil
+}
+
+// keyRotationLoop polls maybeRotateKey on keyRotationCheckInterval until
+// stopCh is closed. It is not started automatically alongside memberlist's
+// other background loops; it runs only where a caller starts it in its own
+// goroutine.
+func (m *Memberlist) keyRotationLoop(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(keyRotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.maybeRotateKey(); err != nil {
+				m.logger.Printf("[ERR] memberlist: key rotation failed: %v", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
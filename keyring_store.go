@@ -0,0 +1,113 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// KeyringStore is implemented by anything that can durably persist and
+// reload a Keyring's contents. A Keyring with a store attached (via
+// SetStore) saves to it automatically after every mutating operation --
+// AddKey, AddKeyWithTerm, RemoveKey, and UseKey -- so an agent can restart
+// without an operator re-supplying keys on the command line.
+type KeyringStore interface {
+	// Load reads back a previously persisted keyring. Returning a nil
+	// *EncodedKeyring with a nil error is valid and means nothing has been
+	// persisted yet.
+	Load() (*EncodedKeyring, error)
+
+	// Save durably persists enc, replacing whatever was previously stored.
+	Save(enc *EncodedKeyring) error
+}
+
+// EncodedKeyringKey is a single key entry within an EncodedKeyring.
+type EncodedKeyringKey struct {
+	// Key is the raw key material.
+	Key []byte `json:"key"`
+
+	// Term is the term the key was installed under.
+	Term uint32 `json:"term"`
+
+	// InstalledAt records when the key was added to the ring, primarily so
+	// operators can audit rotation history.
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// EncodedKeyring is the on-disk representation of a Keyring: its full set of
+// keys, which term is currently primary, and when each key was installed.
+type EncodedKeyring struct {
+	Keys        []EncodedKeyringKey `json:"keys"`
+	PrimaryTerm uint32              `json:"primary_term"`
+}
+
+// FileKeyringStore is the default KeyringStore, backed by a single JSON file
+// on disk. Saves are staged to a temp file in the same directory and then
+// renamed into place, so a crash mid-write can never leave a truncated or
+// partially-written keyring behind.
+type FileKeyringStore struct {
+	path string
+}
+
+// NewFileKeyringStore returns a KeyringStore that persists to the file at
+// path. The parent directory must already exist.
+func NewFileKeyringStore(path string) *FileKeyringStore {
+	return &FileKeyringStore{path: path}
+}
+
+// Load implements KeyringStore.
+func (f *FileKeyringStore) Load() (*EncodedKeyring, error) {
+	raw, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var enc EncodedKeyring
+	if err := json.Unmarshal(raw, &enc); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring file %q: %v", f.path, err)
+	}
+	return &enc, nil
+}
+
+// Save implements KeyringStore. The file is written with 0600 permissions
+// since it contains raw key material.
+func (f *FileKeyringStore) Save(enc *EncodedKeyring) error {
+	raw, err := json.MarshalIndent(enc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode keyring: %v", err)
+	}
+
+	dir := filepath.Dir(f.path)
+	tmp, err := ioutil.TempFile(dir, ".memberlist-keyring-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp keyring file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set keyring file permissions: %v", err)
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keyring file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write keyring file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return fmt.Errorf("failed to install keyring file %q: %v", f.path, err)
+	}
+	return nil
+}